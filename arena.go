@@ -0,0 +1,409 @@
+package freeze
+
+import (
+	"reflect"
+	"sync/atomic"
+	"unsafe"
+)
+
+// FreezeArena accumulates a batch of values to be frozen together, backed by
+// a single mmap'd region. Compared to calling Pointer, Slice, or Object
+// repeatedly -- which performs one mmap and one mprotect syscall (and
+// registers one finalizer) per call -- an arena performs exactly one of
+// each for the whole batch, regardless of how many values, or how large a
+// graph, it contains.
+//
+// A FreezeArena has two phases. During the "build" phase, Pointer, Slice,
+// and Object stage copies of their arguments into a growable buffer, and
+// (for Object) recursively do the same for every pointer, slice, and struct
+// they can reach, rewriting the staged copies so that their internal
+// pointers refer to offsets within the buffer. Nothing is actually
+// protected yet, so the arena's own values -- and the original values they
+// were staged from -- remain mutable during this phase.
+//
+// Freeze ends the build phase: it copies the buffer into a single mmap'd,
+// then mprotect'd region, resolves every staged offset to its final
+// address, and returns the resulting values, in the order they were
+// staged.
+//
+// Maps cannot be folded into an arena's shared buffer, because freezing a
+// map relies on straddling a page boundary so that only part of the map
+// header is protected (see mapFreeze) -- a trick that doesn't compose with
+// an arbitrary neighboring allocation sharing the same mprotect call. Map
+// therefore continues to mmap its own region, both when called directly
+// and when reached via Object; an arena simply batches the allocations
+// around it. The same goes for a channel reached via Object, which Chan
+// freezes in a region of its own.
+type FreezeArena struct {
+	buf    []byte
+	relocs []uintptr
+	roots  []arenaRoot
+	seen   map[unsafe.Pointer]uintptr
+	frozen bool
+}
+
+type arenaRootKind int
+
+const (
+	arenaRootDone  arenaRootKind = iota // value is already final; copy it out verbatim
+	arenaRootPtr                        // value is a pointer into the arena buffer at offset
+	arenaRootSlice                      // value is a slice of length, backed by the arena buffer at offset
+)
+
+type arenaRoot struct {
+	kind     arenaRootKind
+	typ      reflect.Type
+	offset   uintptr
+	length   int
+	capacity int // for arenaRootSlice; preserves cap even though only len elements are staged
+	value    interface{}
+}
+
+// NewArena returns an empty FreezeArena.
+func NewArena() *FreezeArena {
+	return &FreezeArena{seen: make(map[unsafe.Pointer]uintptr)}
+}
+
+func (a *FreezeArena) checkNotFrozen() {
+	if a.frozen {
+		panic("freeze: arena has already been frozen")
+	}
+}
+
+// needsBase reports whether any staged root resolves into the arena buffer,
+// i.e. whether Freeze needs to hand out a non-nil basePtr even if the buffer
+// itself ended up empty.
+func (a *FreezeArena) needsBase() bool {
+	for _, r := range a.roots {
+		if r.kind == arenaRootPtr || r.kind == arenaRootSlice {
+			return true
+		}
+	}
+	return false
+}
+
+// Pointer stages v, which must be a pointer, for freezing. Unlike Object, it
+// does not recurse into v; this matches the behavior of the package-level
+// Pointer function.
+func (a *FreezeArena) Pointer(v interface{}) {
+	a.checkNotFrozen()
+	if v == nil {
+		a.roots = append(a.roots, arenaRoot{kind: arenaRootDone})
+		return
+	}
+	val := reflect.ValueOf(v)
+	if val.Kind() != reflect.Ptr {
+		panic("Pointer called on non-pointer type")
+	}
+	offset := a.stagePointer(val)
+	a.roots = append(a.roots, arenaRoot{kind: arenaRootPtr, typ: val.Type(), offset: offset})
+}
+
+// Slice stages v, which must be a slice, for freezing. Unlike Object, it
+// does not recurse into v; this matches the behavior of the package-level
+// Slice function.
+func (a *FreezeArena) Slice(v interface{}) {
+	a.checkNotFrozen()
+	if v == nil {
+		a.roots = append(a.roots, arenaRoot{kind: arenaRootDone})
+		return
+	}
+	val := reflect.ValueOf(v)
+	if val.Kind() != reflect.Slice {
+		panic("Slice called on non-slice type")
+	}
+	offset, n := a.stageSlice(val)
+	a.roots = append(a.roots, arenaRoot{kind: arenaRootSlice, typ: val.Type(), offset: offset, length: n, capacity: val.Cap()})
+}
+
+// Map stages v, which must be a map, for freezing. Since a map cannot share
+// the arena's buffer (see the FreezeArena docs), this immediately mmaps and
+// freezes v's own region; Freeze merely returns the result alongside the
+// arena's other values.
+func (a *FreezeArena) Map(v interface{}) {
+	a.checkNotFrozen()
+	a.roots = append(a.roots, arenaRoot{kind: arenaRootDone, value: Map(v)})
+}
+
+// Object stages v, which must be a pointer, slice, or map, for recursive
+// freezing; see the package-level Object for the semantics. Every pointer
+// and slice reachable from v is folded into the arena's shared buffer (with
+// the same cycle-detection and deduplication guarantees as Object), except
+// for maps, which are frozen independently as described in the FreezeArena
+// docs.
+func (a *FreezeArena) Object(v interface{}) {
+	a.checkNotFrozen()
+	if v == nil {
+		a.roots = append(a.roots, arenaRoot{kind: arenaRootDone})
+		return
+	}
+	val := reflect.ValueOf(v)
+	switch val.Kind() {
+	case reflect.Ptr:
+		offset := a.objectPointer(val)
+		a.roots = append(a.roots, arenaRoot{kind: arenaRootPtr, typ: val.Type(), offset: offset})
+	case reflect.Slice:
+		offset, n := a.objectSlice(val)
+		a.roots = append(a.roots, arenaRoot{kind: arenaRootSlice, typ: val.Type(), offset: offset, length: n, capacity: val.Cap()})
+	case reflect.Map:
+		// maps can't join the shared buffer; fall back to the standalone,
+		// non-arena implementation, which already handles cycles and
+		// deduplication on its own.
+		a.roots = append(a.roots, arenaRoot{kind: arenaRootDone, value: newObjectCtx(false).object(val).Interface()})
+	default:
+		panic("Object called on invalid type")
+	}
+}
+
+// Freeze ends the build phase, committing every staged value to a single
+// mmap'd region (protected by a single mprotect call and freed by a single
+// finalizer), and returns the resulting values in the order they were
+// staged. The arena cannot be reused afterwards.
+func (a *FreezeArena) Freeze() []interface{} {
+	a.checkNotFrozen()
+	a.frozen = true
+
+	var basePtr unsafe.Pointer
+	if n := len(a.buf); n > 0 || a.needsBase() {
+		// Even when every staged value is zero-sized (e.g. a *struct{} or an
+		// empty-but-non-nil slice), allocate at least one byte so that
+		// basePtr is non-nil; otherwise unsafe.Add(nil, 0) below would turn
+		// such values into nil pointers/slices, which they weren't before
+		// freezing.
+		if n == 0 {
+			n = 1
+		}
+		mem := allocRW(n)
+		copy(mem, a.buf)
+		basePtr = unsafe.Pointer(&mem[0])
+		base := uintptr(basePtr)
+		for _, slot := range a.relocs {
+			*(*uintptr)(unsafe.Pointer(&mem[slot])) += base
+		}
+		if err := protectRO(mem); err != nil {
+			panic(err)
+		}
+	}
+
+	results := make([]interface{}, len(a.roots))
+	for i, r := range a.roots {
+		switch r.kind {
+		case arenaRootDone:
+			results[i] = r.value
+		case arenaRootPtr:
+			results[i] = reflect.NewAt(r.typ.Elem(), unsafe.Add(basePtr, r.offset)).Interface()
+		case arenaRootSlice:
+			results[i] = sliceAt(r.typ, unsafe.Add(basePtr, r.offset), r.length, r.capacity)
+		}
+	}
+	return results
+}
+
+// align pads buf, if necessary, so that the next reservation begins on a
+// word boundary.
+func (a *FreezeArena) align() {
+	const wordSize = unsafe.Sizeof(uintptr(0))
+	if rem := uintptr(len(a.buf)) % wordSize; rem != 0 {
+		a.buf = append(a.buf, make([]byte, wordSize-rem)...)
+	}
+}
+
+// reserve grows buf by n (zeroed) bytes and returns their starting offset.
+func (a *FreezeArena) reserve(n uintptr) uintptr {
+	a.align()
+	offset := uintptr(len(a.buf))
+	a.buf = append(a.buf, make([]byte, n)...)
+	return offset
+}
+
+// writeAt copies n bytes from src into buf[offset:offset+n].
+func (a *FreezeArena) writeAt(offset uintptr, src unsafe.Pointer, n uintptr) {
+	if n == 0 {
+		return
+	}
+	copy(a.buf[offset:offset+n], *(*[]byte)(unsafe.Pointer(&[3]uintptr{uintptr(src), n, n})))
+}
+
+// patchPointer records that, once the arena is frozen, the word at
+// buf[dstOffset] -- which currently holds childOffset -- should be adjusted
+// into an absolute address.
+func (a *FreezeArena) patchPointer(dstOffset, childOffset uintptr) {
+	*(*uintptr)(unsafe.Pointer(&a.buf[dstOffset])) = childOffset
+	a.relocs = append(a.relocs, dstOffset)
+}
+
+// patchSliceHeader is patchPointer for the data pointer of a slice header
+// living at buf[dstOffset:], additionally filling in its len and cap. cap is
+// preserved as-is (even though only len elements are ever staged) so that
+// appending within the original capacity still faults, matching Slice.
+func (a *FreezeArena) patchSliceHeader(dstOffset, childOffset uintptr, length, capacity int) {
+	const wordSize = unsafe.Sizeof(uintptr(0))
+	a.patchPointer(dstOffset, childOffset)
+	*(*int)(unsafe.Pointer(&a.buf[dstOffset+wordSize])) = length
+	*(*int)(unsafe.Pointer(&a.buf[dstOffset+2*wordSize])) = capacity
+}
+
+// stagePointer copies the memory pointed to by val (a non-nil Ptr) into buf
+// and returns its offset, without recursing into it.
+func (a *FreezeArena) stagePointer(val reflect.Value) uintptr {
+	if val.IsNil() {
+		return 0
+	}
+	size := val.Type().Elem().Size()
+	offset := a.reserve(size)
+	a.writeAt(offset, unsafe.Pointer(val.Pointer()), size)
+	return offset
+}
+
+// stageSlice copies val's (a Slice) backing array into buf and returns its
+// offset and length, without recursing into its elements.
+func (a *FreezeArena) stageSlice(val reflect.Value) (offset uintptr, length int) {
+	length = val.Len()
+	size := val.Type().Elem().Size() * uintptr(length)
+	offset = a.reserve(size)
+	if size > 0 {
+		a.writeAt(offset, unsafe.Pointer(val.Pointer()), size)
+	}
+	return offset, length
+}
+
+// objectPointer stages val (a non-nil Ptr) and recursively fixes up any
+// pointers, slices, or maps reachable from it, returning its offset. A
+// pointer that has already been staged (because it's part of a cycle, or
+// because it's aliased elsewhere in the graph) is not staged again.
+func (a *FreezeArena) objectPointer(val reflect.Value) uintptr {
+	if val.IsNil() {
+		return 0
+	}
+	ptr := unsafe.Pointer(val.Pointer())
+	if offset, ok := a.seen[ptr]; ok {
+		return offset
+	}
+	elemType := val.Type().Elem()
+	size := elemType.Size()
+	offset := a.reserve(size)
+	a.seen[ptr] = offset
+	a.writeAt(offset, unsafe.Pointer(ptr), size)
+	if hasPtrs(elemType) {
+		if size >= unsafe.Sizeof(uintptr(0)) {
+			// Touch ptr with an atomic no-op add. This has no effect unless
+			// ptr is already frozen, in which case it panics -- preserving
+			// the documented restriction against calling Object on the same
+			// pointer twice, just as the single-shot implementation's
+			// in-place field rewriting always has. (An ordinary store is
+			// not enough: both the compiler and reflect.Value.Set recognize
+			// a same-address self-assignment and elide it before it
+			// reaches memory.)
+			atomic.AddUintptr((*uintptr)(ptr), 0)
+		}
+		a.fixup(val.Elem(), offset)
+	}
+	return offset
+}
+
+// objectSlice stages val (a Slice) and recursively fixes up any pointers,
+// slices, or maps reachable from its elements, returning its offset and
+// length.
+func (a *FreezeArena) objectSlice(val reflect.Value) (offset uintptr, length int) {
+	length = val.Len()
+	elemType := val.Type().Elem()
+	elemSize := elemType.Size()
+	size := elemSize * uintptr(length)
+
+	var ptr unsafe.Pointer
+	if length > 0 {
+		ptr = unsafe.Pointer(val.Pointer())
+		if cached, ok := a.seen[ptr]; ok {
+			return cached, length
+		}
+	}
+
+	offset = a.reserve(size)
+	if size > 0 {
+		a.writeAt(offset, ptr, size)
+	}
+	if hasPtrs(elemType) {
+		for i := 0; i < length; i++ {
+			a.fixup(val.Index(i), offset+uintptr(i)*elemSize)
+		}
+	}
+	if ptr != nil {
+		a.seen[ptr] = offset
+	}
+	return offset, length
+}
+
+// fixup patches the pointers, slices, and maps within val -- which has
+// already been bulk-copied, verbatim, to buf[dstOffset:] -- so that they
+// refer to their (eventual) frozen locations.
+func (a *FreezeArena) fixup(val reflect.Value, dstOffset uintptr) {
+	switch val.Kind() {
+	case reflect.Ptr:
+		if val.IsNil() {
+			return
+		}
+		a.patchPointer(dstOffset, a.objectPointer(val))
+
+	case reflect.Slice:
+		childOffset, length := a.objectSlice(val)
+		a.patchSliceHeader(dstOffset, childOffset, length, val.Cap())
+
+	case reflect.Map:
+		// A map reached here is nested (the top-level Map case in Object
+		// never calls fixup), so its keys and values must still be
+		// recursively frozen. Maps can't join the arena's shared buffer
+		// (see the FreezeArena docs), so borrow the standalone, non-arena
+		// objectCtx -- the same code path the top-level Map case in Object
+		// delegates to -- rather than threading this through the arena's
+		// own offset-based recursion.
+		if !val.IsNil() && (hasPtrs(val.Type().Elem()) || hasPtrs(val.Type().Key())) {
+			newMap := reflect.MakeMap(val.Type())
+			ctx := newObjectCtx(false)
+			for _, key := range val.MapKeys() {
+				newMap.SetMapIndex(ctx.object(key), ctx.object(val.MapIndex(key)))
+			}
+			val = newMap
+		}
+		frozen := Map(val.Interface())
+		hdr := (*[2]uintptr)(unsafe.Pointer(&frozen))[1]
+		a.writeAt(dstOffset, unsafe.Pointer(&hdr), unsafe.Sizeof(hdr))
+
+	case reflect.Chan:
+		frozen := Chan(val.Interface())
+		hdr := (*[2]uintptr)(unsafe.Pointer(&frozen))[1]
+		a.writeAt(dstOffset, unsafe.Pointer(&hdr), unsafe.Sizeof(hdr))
+
+	case reflect.Func:
+		// Func returns its argument unchanged (see its docs), so the bytes
+		// already staged for this field need no further fixup.
+
+	case reflect.Array:
+		elemType := val.Type().Elem()
+		if hasPtrs(elemType) {
+			elemSize := elemType.Size()
+			for i := 0; i < val.Len(); i++ {
+				a.fixup(val.Index(i), dstOffset+uintptr(i)*elemSize)
+			}
+		}
+
+	case reflect.Struct:
+		for i := 0; i < val.NumField(); i++ {
+			t := val.Type().Field(i)
+			// matches the exported-fields-only restriction in object()
+			if !(t.PkgPath != "" && !t.Anonymous) && hasPtrs(t.Type) {
+				a.fixup(val.Field(i), dstOffset+t.Offset)
+			}
+		}
+	}
+}
+
+// sliceAt constructs a value of slice type typ, with the given length and
+// capacity, backed by the elements at dataptr.
+func sliceAt(typ reflect.Type, dataptr unsafe.Pointer, length, capacity int) interface{} {
+	v := reflect.New(typ).Elem()
+	hdr := (*[3]uintptr)(unsafe.Pointer(v.UnsafeAddr()))
+	hdr[0] = uintptr(dataptr)
+	hdr[1] = uintptr(length)
+	hdr[2] = uintptr(capacity)
+	return v.Interface()
+}
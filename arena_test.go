@@ -0,0 +1,158 @@
+package freeze
+
+import (
+	"testing"
+)
+
+// TestArenaBatch tests that a single FreezeArena can stage values via
+// Pointer, Slice, Object, and Map, and that Freeze returns them, in order,
+// with their data intact.
+func TestArenaBatch(t *testing.T) {
+	type foo struct {
+		S  string
+		IP *int
+		BS []*bool
+	}
+	x := 3
+	tru := true
+	xs := []int{1, 2, 3}
+	f := &foo{"foo", &x, []*bool{&tru}}
+	m := map[int]int{1: 1}
+
+	a := NewArena()
+	a.Pointer(&x)
+	a.Slice(xs)
+	a.Object(f)
+	a.Map(m)
+	results := a.Freeze()
+
+	if got := *results[0].(*int); got != 3 {
+		t.Fatal(got)
+	}
+	if got := results[1].([]int); got[2] != 3 {
+		t.Fatal(got)
+	}
+	ff := results[2].(*foo)
+	if ff.S != "foo" || *ff.IP != 3 || !*ff.BS[0] {
+		t.Fatal(ff)
+	}
+	mm := results[3].(map[int]int)
+	if mm[1] != 1 {
+		t.Fatal(mm)
+	}
+}
+
+// TestArenaZeroSized tests that freezing a zero-sized pointer, or an
+// empty-but-non-nil slice, through an arena doesn't turn them into nil.
+func TestArenaZeroSized(t *testing.T) {
+	a := NewArena()
+	a.Pointer(&struct{}{})
+	a.Slice([]int{})
+	results := a.Freeze()
+
+	if results[0].(*struct{}) == nil {
+		t.Fatal("zero-sized pointer became nil")
+	}
+	if results[1].([]int) == nil {
+		t.Fatal("empty slice became nil")
+	}
+}
+
+// TestArenaDedup tests that an arena deduplicates aliased pointers reached
+// via Object, just as the package-level Object does.
+func TestArenaDedup(t *testing.T) {
+	type node struct {
+		Next *node
+	}
+	shared := &node{}
+	pair := []*node{shared, shared}
+
+	a := NewArena()
+	a.Object(pair)
+	results := a.Freeze()[0].([]*node)
+	if results[0] != results[1] {
+		t.Fatal("aliased pointer was not deduplicated")
+	}
+}
+
+// TestArenaFreezeTwice tests that calling Freeze on an already-frozen arena
+// panics, rather than silently reusing it.
+func TestArenaFreezeTwice(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("Freeze did not panic")
+		}
+	}()
+	a := NewArena()
+	a.Pointer(new(int))
+	a.Freeze()
+	a.Freeze()
+}
+
+// TestArenaBuildAfterFreeze tests that staging a value on an already-frozen
+// arena panics, rather than silently discarding it.
+func TestArenaBuildAfterFreeze(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("Pointer did not panic")
+		}
+	}()
+	a := NewArena()
+	a.Freeze()
+	a.Pointer(new(int))
+}
+
+// TestWriteArenaPointer tests that modifying a value frozen via an arena
+// triggers a panic, just as Pointer does.
+func TestWriteArenaPointer(t *testing.T) {
+	if !*crash {
+		execCrasher(t, "TestWriteArenaPointer")
+		return
+	}
+
+	x := 3
+	a := NewArena()
+	a.Pointer(&x)
+	xp := a.Freeze()[0].(*int)
+	*xp++
+}
+
+// TestWriteArenaObject tests that modifying an object graph frozen via an
+// arena triggers a panic, just as Object does.
+func TestWriteArenaObject(t *testing.T) {
+	if !*crash {
+		execCrasher(t, "TestWriteArenaObject")
+		return
+	}
+
+	type foo struct {
+		BS []*bool
+	}
+	f := &foo{[]*bool{new(bool)}}
+	a := NewArena()
+	a.Object(f)
+	ff := a.Freeze()[0].(*foo)
+	*ff.BS[0] = true
+}
+
+// TestWriteArenaObjectNestedMap tests that a map reached through an arena
+// Object call (as opposed to being staged directly via Map) still has its
+// values recursively frozen, just as the package-level Object does.
+func TestWriteArenaObjectNestedMap(t *testing.T) {
+	if !*crash {
+		execCrasher(t, "TestWriteArenaObjectNestedMap")
+		return
+	}
+
+	type inner struct {
+		X int
+	}
+	type outer struct {
+		M map[string]*inner
+	}
+	o := &outer{M: map[string]*inner{"a": {X: 1}}}
+	a := NewArena()
+	a.Object(o)
+	oo := a.Freeze()[0].(*outer)
+	oo.M["a"].X = 2
+}
@@ -0,0 +1,93 @@
+package freeze
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// Chan returns a frozen copy of v, which must be a channel. Sending on the
+// copy panics, and so does anything else that writes to its header, but
+// receiving from an already-closed, already-drained channel keeps working.
+// This makes Chan chiefly useful for a channel that's been closed and is
+// only being passed around for its remaining reads, such as a broadcast
+// "done" signal: a send is rejected the same way it would be by a closed
+// channel, but without needing to close it.
+//
+// Chan freezes the channel's header (an hchan, in the same sense that Map
+// freezes a map's hmap) using the same two-page split trick as mapFreeze;
+// see its comments for the mechanics. Unlike hmap's count, though, no field
+// of hchan can be carved out as the sole mutable one: every blocking send or
+// receive -- including the fast path for an already-closed, already-drained
+// channel -- locks the channel's mutex before doing anything else, and a
+// lock acquisition is a write. So the field this implementation leaves
+// mutable is lock itself (the last field), not qcount, sendx, or recvx as
+// the buffer pointer and element type might suggest; those, along with
+// everything else in the header, end up frozen too. In practice this is
+// still enough for the common case: receiving from a channel that's closed
+// and has nothing left buffered only reads qcount and elemtype and locks
+// and unlocks the mutex, none of which faults here. Receiving a value that
+// was buffered before the channel was frozen does fault, since draining it
+// requires writing qcount and recvx.
+func Chan(v interface{}) interface{} {
+	if v == nil {
+		return v
+	}
+	val := reflect.ValueOf(v)
+	if val.Kind() != reflect.Chan {
+		panic("Chan called on non-chan type")
+	}
+	if val.IsNil() {
+		return v
+	}
+
+	// freeze the memory pointed to by the interface's data pointer
+	ptrs := (*[2]uintptr)(unsafe.Pointer(&v))
+	ptrs[1] = chanFreeze(ptrs[1])
+
+	return v
+}
+
+// chanFreeze freezes a channel's header, given the address of its hchan,
+// leaving only its trailing lock field mutable; see Chan's docs for why
+// lock, rather than a leading field as in mapFreeze, is the one field that
+// has to stay that way.
+func chanFreeze(dataptr uintptr) uintptr {
+	// copied from runtime/chan.go; recvq, sendq, and lock are opaque to us
+	// and only need to occupy the right number of bytes, so they're
+	// represented by same-sized placeholders rather than the real
+	// (unexported) waitq and mutex types.
+	type hchan struct {
+		qcount   uint
+		dataqsiz uint
+		buf      unsafe.Pointer
+		elemsize uint16
+		closed   uint32
+		elemtype unsafe.Pointer // *_type
+		sendx    uint
+		recvx    uint
+		recvq    [2]uintptr // waitq{first, last *sudog}
+		sendq    [2]uintptr // waitq{first, last *sudog}
+		lock     uintptr    // mutex
+	}
+	var h hchan
+	const size = unsafe.Sizeof(hchan{})
+	lockOffset := unsafe.Offsetof(h.lock)
+	pgSize := pageSize()
+
+	// allocate two pages
+	newMem := allocRW(pgSize + int(size-lockOffset))
+
+	// the channel's header will straddle the page boundary, with lock
+	// landing just past it
+	chanMem := newMem[pgSize-int(lockOffset):]
+
+	// copy the channel data
+	copy(chanMem, *(*[]byte)(unsafe.Pointer(&[3]uintptr{dataptr, size, size})))
+
+	// freeze the "left" page, i.e. everything but lock
+	if err := protectRO(newMem[:pgSize]); err != nil {
+		panic(err)
+	}
+
+	return uintptr(unsafe.Pointer(&chanMem[0]))
+}
@@ -0,0 +1,47 @@
+package freeze
+
+import "testing"
+
+// TestWriteChan tests that sending on a frozen channel triggers a panic.
+func TestWriteChan(t *testing.T) {
+	if !*crash {
+		execCrasher(t, "TestWriteChan")
+		return
+	}
+
+	ch := make(chan int, 1)
+	ch = Chan(ch).(chan int)
+	ch <- 1
+}
+
+// TestReadChan tests that a frozen, closed, and fully-drained channel can
+// still be received from without triggering a panic.
+func TestReadChan(t *testing.T) {
+	ch := make(chan int, 2)
+	ch <- 1
+	ch <- 2
+	<-ch
+	<-ch
+	close(ch)
+
+	ch = Chan(ch).(chan int)
+	v, ok := <-ch
+	if v != 0 || ok {
+		t.Fatalf("got (%d, %v), want (0, false)", v, ok)
+	}
+
+	// should be able to freeze a nil channel
+	var nilCh chan int
+	Chan(nilCh)
+}
+
+// TestChanIllegalType tests that Chan panics when called on a non-chan
+// type.
+func TestChanIllegalType(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("Chan did not panic on non-chan type")
+		}
+	}()
+	Chan(3)
+}
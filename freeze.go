@@ -17,9 +17,13 @@ these unwanted or intended behaviors.
 
 Functions are provided for freezing the three "pointer types:" Pointer, Slice,
 and Map. Each function returns a copy of their input that is backed by
-protected memory. In addition, Object is provided for freezing recursively.
+protected memory. Chan and Func extend the same idea to channels and funcs,
+which are also internally pointers, though each comes with caveats of its
+own (see below). In addition, Object is provided for freezing recursively.
 Given a slice of pointers, Object will prevent modifications to both the
 pointer data and the slice data, while Slice merely does the latter.
+ObjectDeep behaves like Object, but also descends into unexported struct
+fields.
 
 To freeze an object:
 
@@ -54,6 +58,12 @@ method could conceivably modify some internal state. Furthermore, the caveat
 about unexported struct fields (see below) applies here, so many exported
 objects cannot be completely frozen.
 
+Object is safe to call on cyclic structures: it tracks the pointers it has
+already frozen, so a cycle simply causes the existing frozen value to be
+reused instead of triggering infinite recursion. This also means that
+aliased subgraphs (e.g. a slice of pointers that all point to the same
+object) are only frozen once and share a single mmap region.
+
 Caveats
 
 In general, you can't call Object on the same object twice. This is because
@@ -62,7 +72,8 @@ memory modification. Calling Pointer or Slice twice should be fine.
 
 Object cannot descend into unexported struct fields. It can still freeze the
 field itself, but if the field contains a pointer, the data it points to will
-not be frozen.
+not be frozen. Use ObjectDeep if you need to descend into unexported fields
+too.
 
 Appending to a frozen slice will trigger a panic iff len(slice) < cap(slice).
 This is because appending to a full slice will allocate new memory.
@@ -70,57 +81,57 @@ This is because appending to a full slice will allocate new memory.
 Map requires allocating two pages. For the specific reason why, see comments
 in the implementation.
 
-Unix is the only supported platform. Windows support is not planned, because
-it doesn't support a syscall analogous to mprotect.
+Chan, similarly, can only protect a channel's header down to page
+granularity, which leaves its send/receive indices frozen along with
+everything else; see its docs for what that means in practice.
+
+Func is currently a complete no-op: it returns its argument unchanged and
+provides no protection for a closure's captured state at all. It exists only
+for symmetry with the functions above; see its docs for why it can't yet do
+what its name implies.
+
+Unix and Windows are both supported. On Unix, mmap and mprotect are used; on
+Windows, VirtualAlloc and VirtualProtect serve the same purpose.
+
+By default, a write to frozen memory is an unrecoverable fatal error, which
+crashes the process outright. Library code that freezes values on a caller's
+behalf, and so can't guarantee a caller will never violate them, can opt into
+recovering from violations instead; see CatchViolations.
+
+Frozen memory is normally reclaimed by a finalizer, once it becomes
+unreachable, which can leave it resident for an unpredictable amount of time
+in a long-running program. Thaw and Release free it immediately instead; see
+their documentation for the tradeoffs.
 */
 package freeze
 
 import (
 	"reflect"
-	"runtime"
 	"unsafe"
-
-	"golang.org/x/sys/unix"
 )
 
 // Pointer returns a frozen copy of v, which must be a pointer. Future writes
 // to the copy's memory will result in a panic. In most cases, the copy should
 // be reassigned to v.
+//
+// Pointer is a thin wrapper around a single-shot FreezeArena; to freeze many
+// values with a single mmap and mprotect call, use a FreezeArena directly.
 func Pointer(v interface{}) interface{} {
-	if v == nil {
-		return v
-	}
-	typ := reflect.TypeOf(v)
-	if typ.Kind() != reflect.Ptr {
-		panic("Pointer called on non-pointer type")
-	}
-
-	// freeze the memory pointed to by the interface's data pointer
-	size := typ.Elem().Size()
-	ptrs := (*[2]uintptr)(unsafe.Pointer(&v))
-	ptrs[1] = copyAndFreeze(ptrs[1], size)
-
-	return v
+	a := NewArena()
+	a.Pointer(v)
+	return a.Freeze()[0]
 }
 
 // Slice returns a frozen copy of v, which must be a slice. Future writes to
 // the copy's memory will result in a panic. In most cases, the copy should be
 // reassigned to v.
+//
+// Slice is a thin wrapper around a single-shot FreezeArena; to freeze many
+// values with a single mmap and mprotect call, use a FreezeArena directly.
 func Slice(v interface{}) interface{} {
-	if v == nil {
-		return v
-	}
-	val := reflect.ValueOf(v)
-	if val.Kind() != reflect.Slice {
-		panic("Slice called on non-slice type")
-	}
-
-	// freeze the memory pointed to by the slice's data pointer
-	size := val.Type().Elem().Size() * uintptr(val.Len())
-	slice := (*[3]uintptr)((*[2]unsafe.Pointer)(unsafe.Pointer(&v))[1]) // should be [2]uintptr, but go vet complains
-	slice[0] = copyAndFreeze(slice[0], size)
-
-	return v
+	a := NewArena()
+	a.Slice(v)
+	return a.Freeze()[0]
 }
 
 // Map returns a frozen copy of v, which must be a map. Future writes to
@@ -144,33 +155,79 @@ func Map(v interface{}) interface{} {
 
 // Object returns a recursively frozen copy of v, which must be a pointer or a
 // slice. It will descend into pointers, arrays, slices, and structs until
-// "bottoming out," freezing the entire chain. Passing a cyclic structure to
-// Object will result in infinite recursion. Note that Object can only descend
-// into exported struct fields (the fields themselves will still be frozen).
+// "bottoming out," freezing the entire chain. Object is safe to call on
+// cyclic structures, and will deduplicate aliased subgraphs so that they
+// share a single frozen region. Note that Object can only descend into
+// exported struct fields (the fields themselves will still be frozen); use
+// ObjectDeep to descend into unexported fields as well.
+//
+// Object is a thin wrapper around a single-shot FreezeArena; to freeze many
+// object graphs with a single mmap and mprotect call, use a FreezeArena
+// directly.
 func Object(v interface{}) interface{} {
+	if v == nil {
+		return v
+	}
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map:
+	default:
+		panic("Object called on invalid type")
+	}
+	a := NewArena()
+	a.Object(v)
+	return a.Freeze()[0]
+}
+
+// ObjectDeep behaves like Object, except that it also descends into
+// unexported struct fields, freezing any pointers, slices, or maps they
+// contain. This is accomplished by reconstructing an addressable,
+// unexported-field-free reflect.Value for each unexported field from its
+// unsafe.Pointer, in the manner of modern-go/reflect2.
+func ObjectDeep(v interface{}) interface{} {
 	if v == nil {
 		return v
 	}
 	val := reflect.ValueOf(v)
 	switch val.Kind() {
 	case reflect.Ptr, reflect.Slice, reflect.Map:
-		return object(val).Interface()
+		return newObjectCtx(true).object(val).Interface()
 	}
-	panic("Object called on invalid type")
+	panic("ObjectDeep called on invalid type")
 }
 
-// object updates all pointers in val to point to frozen memory containing the
-// same data.
-func object(val reflect.Value) reflect.Value {
-	// we only need to recurse into types that might have pointers
-	hasPtrs := func(t reflect.Type) bool {
-		switch t.Kind() {
-		case reflect.Ptr, reflect.Array, reflect.Slice, reflect.Map, reflect.Struct:
-			return true
-		}
-		return false
+// objectCtx tracks the pointers that have already been frozen during a call
+// to ObjectDeep (or, for a map that Object or a FreezeArena reaches, while
+// freezing that map), keyed by the address of the original (unfrozen) data. This
+// allows object to detect cycles -- reusing the cached frozen value instead
+// of recursing forever -- and to deduplicate aliased subgraphs, so that e.g.
+// a slice of pointers that all point to the same object only freezes that
+// object once.
+type objectCtx struct {
+	seen map[unsafe.Pointer]reflect.Value
+	deep bool // if true, descend into unexported struct fields
+}
+
+func newObjectCtx(deep bool) *objectCtx {
+	return &objectCtx{seen: make(map[unsafe.Pointer]reflect.Value), deep: deep}
+}
+
+// we only need to recurse into types that might have pointers
+func hasPtrs(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Array, reflect.Slice, reflect.Map, reflect.Struct, reflect.Chan, reflect.Func:
+		return true
 	}
+	return false
+}
 
+// object returns a copy of val in which every reachable pointer, slice, and
+// map has been replaced with a frozen equivalent. It never writes through
+// val's own memory to do so -- the Ptr and Slice cases below always copy
+// before recursing -- so the caller's original data comes back unmodified,
+// even though the Struct and Array cases mutate whatever Value they're
+// given in place (safe, since they're only ever handed one of those private
+// copies, never val itself).
+func (ctx *objectCtx) object(val reflect.Value) reflect.Value {
 	switch val.Type().Kind() {
 	default:
 		return val
@@ -178,73 +235,149 @@ func object(val reflect.Value) reflect.Value {
 	case reflect.Ptr:
 		if val.IsNil() {
 			return val
-		} else if hasPtrs(val.Type().Elem()) {
-			val.Elem().Set(object(val.Elem()))
 		}
-		return reflect.ValueOf(Pointer(val.Interface()))
+		ptr := unsafe.Pointer(val.Pointer())
+		if frozen, ok := ctx.seen[ptr]; ok {
+			return frozen
+		}
+		// Reserve the frozen memory -- and register it in ctx.seen -- before
+		// recursing, so that a cycle back to this same pointer (directly, or
+		// via any reachable field) resolves to the final frozen address
+		// instead of recursing forever.
+		elemType := val.Type().Elem()
+		size := elemType.Size()
+		var newMem []byte
+		var frozen reflect.Value
+		if size == 0 {
+			frozen = val
+		} else {
+			newMem = allocRW(int(size))
+			frozen = reflect.NewAt(elemType, unsafe.Pointer(&newMem[0]))
+		}
+		ctx.seen[ptr] = frozen
+		if size > 0 {
+			// Copy the original bytes into newMem before recursing, then
+			// recurse into newMem's own view of them, not val.Elem(): the
+			// Struct/Array cases below mutate whatever Value they're
+			// given in place, and val.Elem() is the caller's own data,
+			// which Object and ObjectDeep must leave untouched.
+			copy(newMem, *(*[]byte)(unsafe.Pointer(&[3]uintptr{uintptr(ptr), size, size})))
+		}
+		if hasPtrs(elemType) {
+			frozen.Elem().Set(ctx.object(frozen.Elem()))
+		}
+		if size > 0 {
+			if err := protectRO(newMem); err != nil {
+				panic(err)
+			}
+		}
+		return frozen
 
 	case reflect.Array:
 		if hasPtrs(val.Type().Elem()) {
 			for i := 0; i < val.Len(); i++ {
-				val.Index(i).Set(object(val.Index(i)))
+				val.Index(i).Set(ctx.object(val.Index(i)))
 			}
 		}
 		return val
 
 	case reflect.Slice:
+		// Zero-length slices of any element type share the same backing
+		// pointer (runtime.zerobase), so keying the cache on ptr != nil
+		// would collide two differently-typed empty slices. Only cache
+		// non-empty slices, which have distinct backing arrays.
+		ptr := unsafe.Pointer(val.Pointer())
+		if val.Len() > 0 {
+			if frozen, ok := ctx.seen[ptr]; ok {
+				return frozen
+			}
+		}
 		if hasPtrs(val.Type().Elem()) {
-			for i := 0; i < val.Len(); i++ {
-				val.Index(i).Set(object(val.Index(i)))
+			// Recurse into a private copy of val's backing array, not
+			// val itself, for the same reason the Ptr case above recurses
+			// into its own copy: val is the caller's own data, and must
+			// come back from Object/ObjectDeep unmodified.
+			cp := reflect.MakeSlice(val.Type(), val.Len(), val.Cap())
+			reflect.Copy(cp, val)
+			for i := 0; i < cp.Len(); i++ {
+				cp.Index(i).Set(ctx.object(cp.Index(i)))
 			}
+			val = cp
 		}
-		return reflect.ValueOf(Slice(val.Interface()))
+		frozen := reflect.ValueOf(Slice(val.Interface()))
+		if val.Len() > 0 {
+			ctx.seen[ptr] = frozen
+		}
+		return frozen
 
 	case reflect.Map:
+		ptr := unsafe.Pointer(val.Pointer())
+		if val.Len() > 0 {
+			if frozen, ok := ctx.seen[ptr]; ok {
+				return frozen
+			}
+		}
 		if hasPtrs(val.Type().Elem()) || hasPtrs(val.Type().Key()) {
 			newMap := reflect.MakeMap(val.Type())
 			for _, key := range val.MapKeys() {
-				newMap.SetMapIndex(object(key), object(val.MapIndex(key)))
+				newMap.SetMapIndex(ctx.object(key), ctx.object(val.MapIndex(key)))
 			}
 			val = newMap
 		}
-		return reflect.ValueOf(Map(val.Interface()))
+		frozen := reflect.ValueOf(Map(val.Interface()))
+		if val.Len() > 0 {
+			ctx.seen[ptr] = frozen
+		}
+		return frozen
+
+	case reflect.Chan:
+		ptr := unsafe.Pointer(val.Pointer())
+		if ptr != nil {
+			if frozen, ok := ctx.seen[ptr]; ok {
+				return frozen
+			}
+		}
+		frozen := reflect.ValueOf(Chan(val.Interface()))
+		if ptr != nil {
+			ctx.seen[ptr] = frozen
+		}
+		return frozen
+
+	case reflect.Func:
+		// Func doesn't return a distinct frozen copy (see its docs), so
+		// there's no cache-worthy result to key by identity; just pass it
+		// through.
+		return reflect.ValueOf(Func(val.Interface()))
 
 	case reflect.Struct:
 		for i := 0; i < val.NumField(); i++ {
-			// can't recurse into unexported fields
 			t := val.Type().Field(i)
-			if !(t.PkgPath != "" && !t.Anonymous) && hasPtrs(t.Type) {
-				val.Field(i).Set(object(val.Field(i)))
+			if !hasPtrs(t.Type) {
+				continue
+			}
+			if !(t.PkgPath != "" && !t.Anonymous) {
+				// exported (or anonymous) field; we can use it directly
+				val.Field(i).Set(ctx.object(val.Field(i)))
+			} else if ctx.deep {
+				// unexported field; reconstruct an addressable Value that
+				// isn't tainted by the read-only flag reflect attaches to
+				// values obtained from unexported fields
+				field := unexportedField(val, t)
+				field.Set(ctx.object(field))
 			}
 		}
 		return val
 	}
 }
 
-// copyAndFreeze copies n bytes from dataptr into new memory, freezes it, and
-// returns a uintptr to the new memory.
-func copyAndFreeze(dataptr, n uintptr) uintptr {
-	if n == 0 {
-		return dataptr
-	}
-	// allocate new memory to be frozen
-	newMem, err := unix.Mmap(-1, 0, int(n), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
-	if err != nil {
-		panic(err)
-	}
-	// set a finalizer to unmap the memory when it would normally be GC'd
-	runtime.SetFinalizer(&newMem, func(b *[]byte) { _ = unix.Munmap(*b) })
-
-	// copy n bytes into newMem
-	copy(newMem, *(*[]byte)(unsafe.Pointer(&[3]uintptr{dataptr, n, n})))
-
-	// freeze the new memory
-	if err = unix.Mprotect(newMem, unix.PROT_READ); err != nil {
-		panic(err)
-	}
-
-	// return pointer to new memory
-	return uintptr(unsafe.Pointer(&newMem[0]))
+// unexportedField returns an addressable, settable reflect.Value for the
+// unexported field t of the struct val, which must itself be addressable.
+// It works by packing the field's address and type into a fresh
+// interface{}, bypassing the read-only flag that reflect normally attaches
+// to values obtained by calling Field on an unexported field.
+func unexportedField(val reflect.Value, t reflect.StructField) reflect.Value {
+	base := unsafe.Pointer(val.Addr().Pointer())
+	return reflect.NewAt(t.Type, unsafe.Pointer(uintptr(base)+t.Offset)).Elem()
 }
 
 // mapFreeze freezes a map's memory. To make this work, we need to work with
@@ -252,10 +385,12 @@ func copyAndFreeze(dataptr, n uintptr) uintptr {
 // hmap object so that we know how many bytes to copy. Secondly, we depend on
 // 'count' being the first field in the struct. Our goal is to freeze only
 // 'count', leaving the rest of the struct mutable. (This is necessary because
-// map iteration modifies the struct.) To accomplish this, we mmap two pages
-// and write the struct onto the boundary between them. The "left" page
+// map iteration modifies the struct.) To accomplish this, we allocate two
+// pages and write the struct onto the boundary between them. The "left" page
 // contains just 'count', and the "right" page contains the rest. We then
-// freeze the left page.
+// freeze the right page, so what ends up read-only is everything except
+// 'count'. The two regions are sized off of pageSize(), since
+// protectRO can only operate on whole pages.
 func mapFreeze(dataptr uintptr) uintptr {
 	// copied from runtime/hmap.go
 	type hmap struct {
@@ -270,24 +405,19 @@ func mapFreeze(dataptr uintptr) uintptr {
 	}
 	const size = unsafe.Sizeof(hmap{})
 	const offset = unsafe.Sizeof(int(0))
-	pageSize := unix.Getpagesize()
+	pgSize := pageSize()
 
 	// allocate two pages
-	newMem, err := unix.Mmap(-1, 0, pageSize+int(size-offset), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
-	if err != nil {
-		panic(err)
-	}
-	// set a finalizer to unmap the memory when it would normally be GC'd
-	runtime.SetFinalizer(&newMem, func(b *[]byte) { _ = unix.Munmap(*b) })
+	newMem := allocRW(pgSize + int(size-offset))
 
 	// the map's memory will straddle the page boundary
-	mapMem := newMem[pageSize-int(offset):]
+	mapMem := newMem[pgSize-int(offset):]
 
 	// copy the map data
 	copy(mapMem, *(*[]byte)(unsafe.Pointer(&[3]uintptr{dataptr, size, size})))
 
 	// freeze the "right" page
-	if err = unix.Mprotect(newMem[pageSize:], unix.PROT_READ); err != nil {
+	if err := protectRO(newMem[pgSize:]); err != nil {
 		panic(err)
 	}
 
@@ -19,8 +19,14 @@ var crash = flag.Bool("crash", false, "")
 func execCrasher(t *testing.T, test string) {
 	cmd := exec.Command(os.Args[0], "-test.run="+test, "-crash")
 	output, _ := cmd.CombinedOutput()
-	if !bytes.Contains(output, []byte("unexpected fault address")) {
-		t.Fatalf("Test did not trigger 'unexpected fault address' panic")
+	// A fault while holding one of the runtime's own locks -- as a chan
+	// send does, since it writes its header fields with c.lock held --
+	// can't go through the usual "unexpected fault address" panic path, so
+	// it's reported as an "unexpected signal" abort instead; either one
+	// confirms the write actually hit protected memory.
+	if !bytes.Contains(output, []byte("unexpected fault address")) &&
+		!bytes.Contains(output, []byte("unexpected signal during runtime execution")) {
+		t.Fatalf("Test did not trigger a memory-protection fault:\n%s", output)
 	}
 }
 
@@ -245,6 +251,22 @@ func TestWriteObjectMapVal(t *testing.T) {
 	*m[1] = 3
 }
 
+// TestWriteObjectChan tests that Object recurses into a struct's chan
+// field, freezing it so that a send on it triggers a panic.
+func TestWriteObjectChan(t *testing.T) {
+	if !*crash {
+		execCrasher(t, "TestWriteObjectChan")
+		return
+	}
+
+	type foo struct {
+		C chan int
+	}
+	f := &foo{make(chan int, 1)}
+	f = Object(f).(*foo)
+	f.C <- 1
+}
+
 // TestWriteObjectInterface tests that calling impure methods on a frozen
 // interface triggers a panic.
 func TestWriteObjectInterface(t *testing.T) {
@@ -426,6 +448,83 @@ func TestReadObject(t *testing.T) {
 
 }
 
+// TestObjectCycle tests that Object can freeze cyclic structures without
+// recursing infinitely, and that the cycle is preserved in the frozen copy.
+func TestObjectCycle(t *testing.T) {
+	type node struct {
+		Next *node
+	}
+	n := &node{}
+	n.Next = n // self-reference
+	n = Object(n).(*node)
+	if n.Next != n {
+		t.Fatal("cycle was not preserved")
+	}
+
+	// a longer cycle, and a shared subgraph reachable two different ways
+	type list struct {
+		Tail *list
+	}
+	a := &list{}
+	b := &list{Tail: a}
+	a.Tail = b
+	shared := []*list{a, b, a}
+	shared = Object(shared).([]*list)
+	if shared[0] != shared[2] {
+		t.Fatal("aliased pointer was not deduplicated")
+	}
+	if shared[0].Tail != shared[1] || shared[1].Tail != shared[0] {
+		t.Fatal("cycle was not preserved")
+	}
+}
+
+// TestObjectMapDoesNotMutateOriginal tests that Object, when it reaches a
+// map, does not mutate pointers in the caller's own graph in place -- only
+// the frozen copy it returns should end up pointing at frozen memory. A
+// pointer reachable through a map takes a different internal path (the
+// standalone objectCtx, rather than FreezeArena's own non-mutating
+// recursion; see FreezeArena.fixup's Map case), so this guards against that
+// path regressing back to its old in-place-mutation behavior, which left
+// the caller's own, never-reassigned pointers referencing frozen memory --
+// a write to which would crash the whole process, rather than merely panic.
+func TestObjectMapDoesNotMutateOriginal(t *testing.T) {
+	type inner struct {
+		X int
+	}
+	type config struct {
+		Nested *inner
+	}
+	type registry struct {
+		Items map[string]*config
+	}
+	c := &config{Nested: &inner{X: 7}}
+	r := &registry{Items: map[string]*config{"a": c}}
+	Object(r)
+
+	// c, and everything reachable from it, was never reassigned by the
+	// caller, so it must still be ordinary, mutable memory; if Object
+	// mutated it in place instead, this write would fault.
+	c.Nested.X = 99
+	if c.Nested.X != 99 {
+		t.Fatal("write to original data did not take effect")
+	}
+}
+
+// TestObjectEmptySlices tests that two differently-typed empty slices
+// reachable from the same Object call don't collide in the dedup cache
+// (all zero-length slices share the same backing pointer).
+func TestObjectEmptySlices(t *testing.T) {
+	type foo struct {
+		A []int
+		B []string
+	}
+	f := &foo{A: []int{}, B: []string{}}
+	f = Object(f).(*foo)
+	if f.A == nil || f.B == nil {
+		t.Fatal("empty slices should be preserved, not nil'd out")
+	}
+}
+
 // TestFreezeUnexportedObject tests that Object will not descend into
 // unexported fields.
 func TestFreezeUnexportedObject(t *testing.T) {
@@ -438,6 +537,50 @@ func TestFreezeUnexportedObject(t *testing.T) {
 	f.b[0] = 9
 }
 
+// TestWriteObjectDeepUnexported tests that ObjectDeep does descend into
+// unexported fields, freezing them.
+func TestWriteObjectDeepUnexported(t *testing.T) {
+	if !*crash {
+		execCrasher(t, "TestWriteObjectDeepUnexported")
+		return
+	}
+
+	type foo struct {
+		b []byte
+	}
+	f := &foo{[]byte{1, 2, 3}}
+	f = ObjectDeep(f).(*foo)
+	f.b[0] = 9
+}
+
+// TestReadObjectDeepUnexported tests that ObjectDeep-frozen unexported
+// fields can still be read.
+func TestReadObjectDeepUnexported(t *testing.T) {
+	type foo struct {
+		b []byte
+	}
+	f := &foo{[]byte{1, 2, 3}}
+	f = ObjectDeep(f).(*foo)
+	if f.b[1] != 2 {
+		t.Fatal(f.b)
+	}
+}
+
+// TestObjectDeepEmptySlices tests that ObjectDeep's dedup cache doesn't
+// collide two unexported, differently-typed empty-slice fields (which,
+// as unexported fields, can only be reached via ObjectDeep).
+func TestObjectDeepEmptySlices(t *testing.T) {
+	type foo struct {
+		a []int
+		b []string
+	}
+	f := &foo{a: []int{}, b: []string{}}
+	f = ObjectDeep(f).(*foo)
+	if f.a == nil || f.b == nil {
+		t.Fatal("empty slices should be preserved, not nil'd out")
+	}
+}
+
 // TestWriteSlicePointers tests that the elements of a frozen slice of
 // pointers can be modified without triggering a panic.
 func TestWriteSlicePointers(t *testing.T) {
@@ -0,0 +1,71 @@
+//go:build !windows
+// +build !windows
+
+package freeze
+
+import (
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// allocRW mmaps n bytes of readable, writable memory, registers it (see
+// registerRegion), and attaches a finalizer to unregister and unmap it once
+// it becomes unreachable -- unless Thaw or Release has already done so, in
+// which case the finalizer is a no-op (see the region docs in registry.go).
+func allocRW(n int) []byte {
+	newMem, err := unix.Mmap(-1, 0, n, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		panic(err)
+	}
+	var released int32
+	registerRegion(&newMem, &released)
+	base := uintptr(unsafe.Pointer(&newMem[0]))
+	runtime.SetFinalizer(&newMem, func(b *[]byte) {
+		if atomic.CompareAndSwapInt32(&released, 0, 1) {
+			unregisterRegion(base)
+			_ = unix.Munmap(*b)
+		}
+	})
+	return newMem
+}
+
+// protectRO marks b, a slice previously returned by allocRW, as read-only.
+func protectRO(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	return unix.Mprotect(b, unix.PROT_READ)
+}
+
+// releaseNow restores mem -- a slice previously returned by allocRW -- to
+// read-write and unmaps it immediately. It's the synchronous counterpart to
+// the finalizer allocRW attaches, used by Thaw and Release once they've
+// taken mem out of the registry and won the race to release it (see the
+// region docs).
+func releaseNow(mem []byte) {
+	if len(mem) == 0 {
+		return
+	}
+	_ = unix.Mprotect(mem, unix.PROT_READ|unix.PROT_WRITE)
+	_ = unix.Munmap(mem)
+}
+
+// restoreRW marks mem, a slice previously returned by allocRW and since
+// protected, as read-write again, without unmapping it. Thaw uses this to
+// make a frozen map's memory safe to copy out before releasing it; see
+// copyOutMap.
+func restoreRW(mem []byte) error {
+	if len(mem) == 0 {
+		return nil
+	}
+	return unix.Mprotect(mem, unix.PROT_READ|unix.PROT_WRITE)
+}
+
+// pageSize returns the size of a page of memory, as used by mapFreeze to
+// align its two regions.
+func pageSize() int {
+	return unix.Getpagesize()
+}
@@ -0,0 +1,91 @@
+//go:build windows
+// +build windows
+
+package freeze
+
+import (
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// allocRW reserves and commits n bytes of readable, writable memory via
+// VirtualAlloc, registers it (see registerRegion), and attaches a finalizer
+// to unregister and release it (via VirtualFree) once it becomes
+// unreachable -- unless Thaw or Release has already done so, in which case
+// the finalizer is a no-op (see the region docs in registry.go).
+func allocRW(n int) []byte {
+	if n == 0 {
+		n = 1 // VirtualAlloc rejects a zero-size request
+	}
+	addr, err := windows.VirtualAlloc(0, uintptr(n), windows.MEM_COMMIT|windows.MEM_RESERVE, windows.PAGE_READWRITE)
+	if err != nil {
+		panic(err)
+	}
+	// unsafe.Add(nil, addr), rather than unsafe.Pointer(addr) directly,
+	// keeps go vet's unsafeptr check happy: VirtualAlloc's return value is a
+	// uintptr address, not one derived from an existing Go pointer, so the
+	// direct conversion doesn't match any of the patterns vet recognizes as
+	// safe.
+	newMem := unsafe.Slice((*byte)(unsafe.Add(nil, addr)), n)
+	var released int32
+	registerRegion(&newMem, &released)
+	base := uintptr(unsafe.Pointer(&newMem[0]))
+	runtime.SetFinalizer(&newMem, func(b *[]byte) {
+		if atomic.CompareAndSwapInt32(&released, 0, 1) {
+			unregisterRegion(base)
+			_ = windows.VirtualFree(uintptr(unsafe.Pointer(&(*b)[0])), 0, windows.MEM_RELEASE)
+		}
+	})
+	return newMem
+}
+
+// protectRO marks b, a slice previously returned by allocRW, as read-only via
+// VirtualProtect. VirtualProtect operates on every whole page that b
+// touches, so b must begin on a page boundary, and the protection extends
+// to the end of b's last page; mapFreeze and chanFreeze arrange for the
+// former by sizing their regions off of pageSize().
+func protectRO(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	var old uint32
+	return windows.VirtualProtect(uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), windows.PAGE_READONLY, &old)
+}
+
+// releaseNow restores mem -- a slice previously returned by allocRW -- to
+// read-write and releases it immediately via VirtualFree. It's the
+// synchronous counterpart to the finalizer allocRW attaches, used by Thaw
+// and Release once they've taken mem out of the registry and won the race
+// to release it (see the region docs).
+func releaseNow(mem []byte) {
+	if len(mem) == 0 {
+		return
+	}
+	var old uint32
+	_ = windows.VirtualProtect(uintptr(unsafe.Pointer(&mem[0])), uintptr(len(mem)), windows.PAGE_READWRITE, &old)
+	_ = windows.VirtualFree(uintptr(unsafe.Pointer(&mem[0])), 0, windows.MEM_RELEASE)
+}
+
+// restoreRW marks mem, a slice previously returned by allocRW and since
+// protected, as read-write again, without releasing it. Thaw uses this to
+// make a frozen map's memory safe to copy out before releasing it; see
+// copyOutMap.
+func restoreRW(mem []byte) error {
+	if len(mem) == 0 {
+		return nil
+	}
+	var old uint32
+	return windows.VirtualProtect(uintptr(unsafe.Pointer(&mem[0])), uintptr(len(mem)), windows.PAGE_READWRITE, &old)
+}
+
+// pageSize returns the size of a page of memory, as used by mapFreeze to
+// align its two regions. Windows page size is architecturally fixed at
+// 4096 bytes on all platforms it runs on; unlike VirtualAlloc's allocation
+// granularity (64KB), there is no portable API to query it, so we hardcode
+// it here.
+func pageSize() int {
+	return 4096
+}
@@ -0,0 +1,38 @@
+package freeze
+
+import "reflect"
+
+// Func exists for symmetry with Pointer, Slice, Map, and Chan, but -- unlike
+// all of those -- is currently a complete no-op: it returns v, which must be
+// a func, unchanged, and provides no immutability guarantee whatsoever for
+// its captured state. Do not call Func expecting it to protect anything;
+// it exists only as a typed placeholder until the problem below has a
+// portable solution.
+//
+// A func value is a pointer to a funcval, whose first word is a code
+// pointer followed by a compiler-generated, variable-length region holding
+// whatever the closure captured (see the "variable-size, fn-specific data"
+// comment on runtime's funcval type). Every other function in this package
+// protects a region by copying it into a same-sized mmap'd allocation and
+// mprotecting that -- but Go does not expose a funcval's total size through
+// reflect or any other portable API, and the original can't be protected in
+// place, since it lives on the ordinary Go heap alongside unrelated objects
+// rather than in its own page. Allocating a copy sized only to the known
+// part (the code pointer) isn't a safe middle ground either: calling the
+// result would read the captured data immediately following that pointer,
+// past the end of the smaller allocation, and fault. Lacking a way to size
+// the copy correctly, Func leaves v alone rather than risk either of those
+// outcomes.
+//
+// If a closure's captured state needs to be immutable, freeze it at the
+// point it's captured instead (e.g. with Pointer or Object, before the
+// closure literal is created).
+func Func(v interface{}) interface{} {
+	if v == nil {
+		return v
+	}
+	if reflect.ValueOf(v).Kind() != reflect.Func {
+		panic("Func called on non-func type")
+	}
+	return v
+}
@@ -0,0 +1,31 @@
+package freeze
+
+import "testing"
+
+// TestFuncNoop tests that Func returns its argument unchanged, and that a
+// closure's captured state remains mutable afterwards (see Func's docs for
+// why it can't be frozen).
+func TestFuncNoop(t *testing.T) {
+	x := 1
+	f := func() int { return x }
+	f2 := Func(f).(func() int)
+	x = 2
+	if f2() != 2 {
+		t.Fatal("Func's result stopped reflecting its closure's captured variable")
+	}
+
+	// should be able to freeze nil
+	var nilFunc func()
+	Func(nilFunc)
+}
+
+// TestFuncIllegalType tests that Func panics when called on a non-func
+// type.
+func TestFuncIllegalType(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("Func did not panic on non-func type")
+		}
+	}()
+	Func(3)
+}
@@ -0,0 +1,136 @@
+package freeze
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// region describes a byte range of memory that has been handed to
+// protectRO. Ranges are allowed to include bytes that are not themselves
+// read-only (mapFreeze registers its whole two-page allocation, even though
+// only the second page is actually protected); since a write can only ever
+// fault inside the protected part, that's harmless for isFrozenAddr's
+// purposes, and a lookup by an interior address (e.g. a frozen map's data
+// pointer, which points partway into its allocation) is exactly what Thaw
+// and Release need anyway.
+//
+// data is the same address as base, kept as an unsafe.Pointer (rather than
+// re-deriving it from base, a uintptr, at release time) so that Thaw and
+// Release can hand it to releaseNow without the uintptr-to-Pointer
+// conversion go vet's unsafeptr check flags. Unlike the *[]byte allocRW
+// attaches its finalizer to, data points directly at the mmap'd bytes
+// themselves -- memory the Go runtime doesn't manage at all -- so storing
+// it here indefinitely doesn't keep anything reachable that would
+// otherwise be collected.
+//
+// released is shared with the *[]byte that allocRW attached a finalizer to.
+// Whichever of the finalizer or an explicit Thaw/Release call reaches it
+// first CAS's it from 0 to 1 and does the actual release; the other is then
+// a no-op. This lets Thaw and Release release the memory immediately
+// without needing to cancel the original finalizer (which would require
+// holding a real pointer to its target here, keeping that target -- and so
+// the memory it would otherwise reclaim -- artificially reachable forever).
+type region struct {
+	base, end uintptr
+	data      unsafe.Pointer
+	released  *int32
+}
+
+// frozenRegions holds the current set of regions, sorted by base address,
+// so that isFrozenAddr can binary-search it without a lock. Updates replace
+// the slice wholesale rather than mutating it in place, so a concurrent
+// reader always sees a complete, consistent snapshot; registryMu serializes
+// the updates themselves, so that two concurrent writers (e.g. a freeze
+// racing a finalizer, or a Thaw racing that same finalizer) can't each
+// build on the same stale snapshot and clobber one another's change.
+var (
+	frozenRegions atomic.Value // []region
+	registryMu    sync.Mutex
+)
+
+func init() {
+	frozenRegions.Store([]region{})
+}
+
+// registerRegion records mem -- a slice just returned by allocRW, which has
+// already had a finalizer attached to it that checks released -- as
+// belonging to freeze.
+func registerRegion(mem *[]byte, released *int32) {
+	if len(*mem) == 0 {
+		return
+	}
+	data := unsafe.Pointer(&(*mem)[0])
+	base := uintptr(data)
+	end := base + uintptr(len(*mem))
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	old := frozenRegions.Load().([]region)
+	i := sort.Search(len(old), func(i int) bool { return old[i].base >= base })
+	next := make([]region, len(old)+1)
+	copy(next, old[:i])
+	next[i] = region{base, end, data, released}
+	copy(next[i+1:], old[i:])
+	frozenRegions.Store(next)
+}
+
+// unregisterRegion removes the region starting at base, if one is still
+// registered. It is called from allocRW's finalizer just before the backing
+// memory is unmapped, so that a later fault at a reused address is never
+// mistaken for a freeze violation.
+func unregisterRegion(base uintptr) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	removeRegionLocked(base)
+}
+
+// removeRegionLocked removes and returns the region starting at base, if
+// one is still registered. The caller must hold registryMu.
+func removeRegionLocked(base uintptr) (region, bool) {
+	old := frozenRegions.Load().([]region)
+	for i, r := range old {
+		if r.base == base {
+			next := make([]region, len(old)-1)
+			copy(next, old[:i])
+			copy(next[i:], old[i+1:])
+			frozenRegions.Store(next)
+			return r, true
+		}
+	}
+	return region{}, false
+}
+
+// regionContaining returns the region that contains addr, if any.
+func regionContaining(addr uintptr) (region, bool) {
+	regions := frozenRegions.Load().([]region)
+	i := sort.Search(len(regions), func(i int) bool { return regions[i].base > addr })
+	if i == 0 {
+		return region{}, false
+	}
+	r := regions[i-1]
+	if addr >= r.base && addr < r.end {
+		return r, true
+	}
+	return region{}, false
+}
+
+// isFrozenAddr reports whether addr falls within memory that freeze has
+// protected.
+func isFrozenAddr(addr uintptr) bool {
+	_, ok := regionContaining(addr)
+	return ok
+}
+
+// takeRegion removes and returns the region containing addr, if any. Thaw
+// and Release use it to claim a region for release exactly once, even if
+// they race with each other or with the region's own finalizer.
+func takeRegion(addr uintptr) (region, bool) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	r, ok := regionContaining(addr)
+	if !ok {
+		return region{}, false
+	}
+	return removeRegionLocked(r.base)
+}
@@ -0,0 +1,203 @@
+package freeze
+
+import (
+	"reflect"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Thaw undoes a previous freeze: it copies v's current contents into a
+// fresh, mutable Go-heap value, deterministically releases the frozen
+// memory backing v -- rather than waiting for the garbage collector to do
+// so via a finalizer -- and returns the mutable copy. v must be a pointer,
+// slice, or map previously returned by one of this package's freezing
+// functions; Thaw is a safe no-op, returning v unchanged, on any value that
+// this package never froze.
+//
+// Thawing a value that was frozen as part of a FreezeArena batch (which
+// includes any value from the package-level Pointer, Slice, or Object,
+// since they're thin wrappers around a single-shot arena) releases the
+// whole shared region, since every value in a batch shares one mmap'd
+// allocation. Don't call Thaw or Release on a value from a multi-value
+// arena batch unless you're done with every other value in that batch too.
+func Thaw(v interface{}) interface{} {
+	r, ok := regionOf(v)
+	if !ok {
+		return v
+	}
+	cp := copyOut(reflect.ValueOf(v), r)
+	release(r)
+	return cp
+}
+
+// Release immediately and deterministically frees the memory backing v,
+// rather than waiting for the garbage collector to do so via v's
+// finalizer. Unlike Thaw, it does not return a usable copy: v, and anything
+// that aliases its memory, must not be read or written again afterwards.
+// Release is a safe no-op on any value that this package never froze.
+//
+// As with Thaw, releasing one value from a FreezeArena batch releases the
+// whole shared region; see Thaw's documentation.
+func Release(v interface{}) {
+	if r, ok := regionOf(v); ok {
+		release(r)
+	}
+}
+
+// regionOf returns the registered region backing v's data pointer, if v is
+// a non-nil pointer, slice, or map that this package froze. The region is
+// removed from the registry as a side effect (see takeRegion), so that it's
+// only ever released once even if Thaw or Release races with another call
+// on the same value.
+func regionOf(v interface{}) (region, bool) {
+	if v == nil {
+		return region{}, false
+	}
+	val := reflect.ValueOf(v)
+	switch val.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map:
+	default:
+		return region{}, false
+	}
+	if val.IsNil() {
+		return region{}, false
+	}
+	return takeRegion(val.Pointer())
+}
+
+// release frees r's memory right away, unless r's finalizer has already
+// beaten this call to it (see the region docs).
+func release(r region) {
+	if !atomic.CompareAndSwapInt32(r.released, 0, 1) {
+		return
+	}
+	mem := unsafe.Slice((*byte)(r.data), r.end-r.base)
+	releaseNow(mem)
+}
+
+// copyOut returns a mutable copy of val's current contents, backed by
+// ordinary Go-heap memory, in the manner appropriate to its kind, recursing
+// into every pointer, slice, map, array, and struct field reachable from it
+// -- mirroring objectCtx.object's own traversal -- before release(r) runs.
+// A map's entries are copied as they are, without recursing into them (see
+// copyOutMap). This matters because Object folds every pointer and slice it
+// reaches into one shared arena buffer, so a field one level below the root is
+// backed by that same buffer; copying only the root, as this function used
+// to, would leave such a field pointing into memory Thaw is about to
+// release. r is val's own region, as returned alongside it by regionOf; the
+// Map case needs it to work around mapFreeze (see copyOutMap).
+func copyOut(val reflect.Value, r region) interface{} {
+	switch val.Kind() {
+	case reflect.Ptr:
+		cp := reflect.New(val.Type().Elem())
+		cp.Elem().Set(deepCopy(val.Elem()))
+		return cp.Interface()
+	case reflect.Slice:
+		cp := reflect.MakeSlice(val.Type(), val.Len(), val.Cap())
+		if hasPtrs(val.Type().Elem()) {
+			for i := 0; i < val.Len(); i++ {
+				cp.Index(i).Set(deepCopy(val.Index(i)))
+			}
+		} else {
+			reflect.Copy(cp, val)
+		}
+		return cp.Interface()
+	default: // reflect.Map
+		return copyOutMap(val, r)
+	}
+}
+
+// deepCopy is copyOut's recursive counterpart for everything below the
+// root. A pointer or slice reached this way gets no regionOf lookup -- just
+// a plain copy, taken while its memory is still valid (i.e. before Thaw
+// releases r). Under Object it shares the root's own arena buffer; one with
+// a region of its own (as under ObjectDeep) is copied but not released. A map, however, is never folded into the shared
+// buffer (see the FreezeArena docs) and so always has its own region; it is
+// found and released here as it's copied out, the same way Thaw releases
+// the root's. Chan and Func fields are passed through unchanged: Thaw
+// doesn't support thawing either on its own (see its docs), and recursing
+// into them here would be inconsistent with that.
+func deepCopy(val reflect.Value) reflect.Value {
+	switch val.Kind() {
+	case reflect.Ptr:
+		if val.IsNil() {
+			return val
+		}
+		cp := reflect.New(val.Type().Elem())
+		cp.Elem().Set(deepCopy(val.Elem()))
+		return cp
+
+	case reflect.Slice:
+		cp := reflect.MakeSlice(val.Type(), val.Len(), val.Cap())
+		if hasPtrs(val.Type().Elem()) {
+			for i := 0; i < val.Len(); i++ {
+				cp.Index(i).Set(deepCopy(val.Index(i)))
+			}
+		} else {
+			reflect.Copy(cp, val)
+		}
+		return cp
+
+	case reflect.Map:
+		if val.IsNil() {
+			return val
+		}
+		if mr, ok := regionOf(val.Interface()); ok {
+			defer release(mr)
+			return reflect.ValueOf(copyOutMap(val, mr))
+		}
+		return val
+
+	case reflect.Array:
+		cp := reflect.New(val.Type()).Elem()
+		if hasPtrs(val.Type().Elem()) {
+			for i := 0; i < val.Len(); i++ {
+				cp.Index(i).Set(deepCopy(val.Index(i)))
+			}
+		} else {
+			cp.Set(val)
+		}
+		return cp
+
+	case reflect.Struct:
+		cp := reflect.New(val.Type()).Elem()
+		cp.Set(val)
+		for i := 0; i < val.NumField(); i++ {
+			t := val.Type().Field(i)
+			if !hasPtrs(t.Type) {
+				continue
+			}
+			if t.PkgPath != "" && !t.Anonymous {
+				// unexported field; reconstruct addressable, settable
+				// Values the same way objectCtx.object does
+				unexportedField(cp, t).Set(deepCopy(unexportedField(val, t)))
+			} else {
+				cp.Field(i).Set(deepCopy(val.Field(i)))
+			}
+		}
+		return cp
+
+	default: // Chan, Func, and anything without pointers
+		return val
+	}
+}
+
+// copyOutMap copies a frozen map's entries into a fresh, mutable map.
+// Iterating a map -- even just to read it -- briefly marks its header as
+// "being iterated," which is a write; mapFreeze's page-straddling trick (see
+// freeze.go) leaves most of that header on the page it protects, so iterating
+// a frozen map via reflect (or even a plain range statement) always panics,
+// with or without Thaw. Since Thaw is about to release r's memory anyway, it
+// sidesteps this by restoring write access first.
+func copyOutMap(val reflect.Value, r region) interface{} {
+	mem := unsafe.Slice((*byte)(r.data), r.end-r.base)
+	if err := restoreRW(mem); err != nil {
+		panic(err)
+	}
+	cp := reflect.MakeMapWithSize(val.Type(), val.Len())
+	iter := val.MapRange()
+	for iter.Next() {
+		cp.SetMapIndex(iter.Key(), iter.Value())
+	}
+	return cp.Interface()
+}
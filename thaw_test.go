@@ -0,0 +1,135 @@
+package freeze
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// TestThawPointer tests that Thaw returns a mutable copy of a frozen
+// pointer's data, and that the original frozen memory is released.
+func TestThawPointer(t *testing.T) {
+	x := 3
+	frozen := Pointer(&x).(*int)
+	addr := uintptr(unsafe.Pointer(frozen))
+
+	thawed := Thaw(frozen).(*int)
+	if *thawed != 3 {
+		t.Fatalf("thawed value = %d, want 3", *thawed)
+	}
+	*thawed = 4 // must not panic
+	if *thawed != 4 {
+		t.Fatal("write to thawed pointer did not take effect")
+	}
+	if isFrozenAddr(addr) {
+		t.Fatal("frozen memory was not released by Thaw")
+	}
+}
+
+// TestThawSlice tests that Thaw returns a mutable copy of a frozen slice,
+// preserving its contents and capacity.
+func TestThawSlice(t *testing.T) {
+	xs := make([]int, 2, 4)
+	xs[0], xs[1] = 1, 2
+	frozen := Slice(xs).([]int)
+
+	thawed := Thaw(frozen).([]int)
+	if len(thawed) != 2 || cap(thawed) != 4 {
+		t.Fatalf("thawed slice has len %d cap %d, want len 2 cap 4", len(thawed), cap(thawed))
+	}
+	thawed = append(thawed, 3) // within original cap; must not panic
+	if thawed[0] != 1 || thawed[1] != 2 || thawed[2] != 3 {
+		t.Fatal("thawed slice contents are wrong")
+	}
+}
+
+// TestThawMap tests that Thaw returns a mutable copy of a frozen map.
+func TestThawMap(t *testing.T) {
+	m := map[string]int{"a": 1}
+	frozen := Map(m).(map[string]int)
+
+	thawed := Thaw(frozen).(map[string]int)
+	if thawed["a"] != 1 {
+		t.Fatalf("thawed map missing entry: %v", thawed)
+	}
+	thawed["b"] = 2 // must not panic
+	if len(thawed) != 2 {
+		t.Fatal("write to thawed map did not take effect")
+	}
+}
+
+// TestThawObjectNested tests that Thaw deep-copies an Object result's
+// reachable substructure, not just its root, out of the arena before
+// releasing it: a field one level below the root must remain both readable
+// and writable afterwards, even though the root's region has been released.
+func TestThawObjectNested(t *testing.T) {
+	type inner struct {
+		X int
+	}
+	type outer struct {
+		P *inner
+	}
+	o := &outer{P: &inner{X: 42}}
+	frozen := Object(o).(*outer)
+	innerAddr := uintptr(unsafe.Pointer(frozen.P))
+
+	thawed := Thaw(frozen).(*outer)
+	if isFrozenAddr(innerAddr) {
+		t.Fatal("Thaw did not release the nested pointer's (shared) region")
+	}
+	if thawed.P.X != 42 {
+		t.Fatalf("thawed.P.X = %d, want 42", thawed.P.X)
+	}
+	thawed.P.X = 7 // must not panic, and must not alias the released memory
+	if thawed.P.X != 7 {
+		t.Fatal("write to thawed nested pointer did not take effect")
+	}
+}
+
+// TestThawUnfrozen tests that Thaw is a safe no-op -- returning its
+// argument unchanged -- on a value this package never froze.
+func TestThawUnfrozen(t *testing.T) {
+	x := new(int)
+	if Thaw(x).(*int) != x {
+		t.Fatal("Thaw modified an unfrozen pointer")
+	}
+	if Thaw(nil) != nil {
+		t.Fatal("Thaw(nil) != nil")
+	}
+}
+
+// TestRelease tests that Release immediately frees a frozen value's memory,
+// rather than waiting for the garbage collector to do so.
+func TestRelease(t *testing.T) {
+	xp := Pointer(new(int)).(*int)
+	addr := uintptr(unsafe.Pointer(xp))
+	if !isFrozenAddr(addr) {
+		t.Fatal("freshly frozen address was not registered")
+	}
+	Release(xp)
+	if isFrozenAddr(addr) {
+		t.Fatal("Release did not free the memory immediately")
+	}
+}
+
+// TestReleaseUnfrozen tests that Release is a safe no-op on a value this
+// package never froze.
+func TestReleaseUnfrozen(t *testing.T) {
+	Release(new(int))
+	Release(nil)
+}
+
+// TestThawArenaBatch tests that thawing one value out of a FreezeArena
+// batch releases the whole shared region, as documented.
+func TestThawArenaBatch(t *testing.T) {
+	a := NewArena()
+	a.Pointer(new(int))
+	a.Pointer(new(int))
+	results := a.Freeze()
+	first, second := results[0].(*int), results[1].(*int)
+	secondAddr := uintptr(unsafe.Pointer(second))
+
+	Thaw(first)
+	if isFrozenAddr(secondAddr) {
+		t.Fatal("thawing one arena value should release the whole shared region")
+	}
+}
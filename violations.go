@@ -0,0 +1,60 @@
+package freeze
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// A FreezeViolationError is recovered, in place of the usual unrecoverable
+// panic, when a goroutine wrapped in CatchViolations writes to memory that
+// this package has frozen.
+type FreezeViolationError struct {
+	Addr uintptr // the address that was written to
+}
+
+func (e *FreezeViolationError) Error() string {
+	return fmt.Sprintf("freeze: illegal write to frozen memory at %#x", e.Addr)
+}
+
+// CatchViolations enables freeze-violation recovery for the calling
+// goroutine, for library code that must not crash the process just because
+// a caller mutated a frozen value. It returns a function that must be
+// deferred after (so that, per defer's LIFO order, it runs before) any of
+// your own recover calls:
+//
+//	defer func() {
+//		if err := recover(); err != nil {
+//			// handle err, which is a *FreezeViolationError if (and only
+//			// if) the code below wrote to frozen memory
+//		}
+//	}()
+//	defer freeze.CatchViolations()()
+//
+// If a write to memory frozen by this package faults before the deferred
+// call runs, the panic is translated to a *FreezeViolationError, which an
+// enclosing recover can then handle like any other panic. Faults at any
+// other address -- including ordinary nil pointer dereferences -- propagate
+// unchanged.
+//
+// Without CatchViolations, a write to frozen memory is an unrecoverable
+// fatal error that terminates the process; this function, and the
+// bookkeeping it relies on, are entirely opt-in.
+func CatchViolations() func() {
+	prev := debug.SetPanicOnFault(true)
+	return func() {
+		// Restore panic-on-fault to whatever it was before, so that the
+		// relaxed fault handling doesn't leak into code outside the
+		// caller's protected section and mask unrelated memory corruption.
+		defer debug.SetPanicOnFault(prev)
+		r := recover()
+		if r == nil {
+			return
+		}
+		if ae, ok := r.(interface{ Addr() uintptr }); ok {
+			if addr := ae.Addr(); isFrozenAddr(addr) {
+				panic(&FreezeViolationError{Addr: addr})
+			}
+		}
+		panic(r)
+	}
+}
@@ -0,0 +1,91 @@
+package freeze
+
+import (
+	"runtime"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// protectedWrite writes *xp = 5, converting a write to frozen memory into a
+// *FreezeViolationError instead of crashing the process.
+func protectedWrite(xp *int) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if fe, ok := r.(*FreezeViolationError); ok {
+				err = fe
+				return
+			}
+			panic(r)
+		}
+	}()
+	defer CatchViolations()()
+
+	*xp++
+	return nil
+}
+
+// TestCatchViolations tests that a write to frozen memory, within a
+// CatchViolations-wrapped call, is recovered as a *FreezeViolationError
+// instead of crashing the process.
+func TestCatchViolations(t *testing.T) {
+	x := 3
+	xp := Pointer(&x).(*int)
+
+	err := protectedWrite(xp)
+	if err == nil {
+		t.Fatal("expected a FreezeViolationError, got nil")
+	}
+	if _, ok := err.(*FreezeViolationError); !ok {
+		t.Fatalf("expected a *FreezeViolationError, got %T (%v)", err, err)
+	}
+
+	// the frozen memory should remain untouched and still read-only
+	if *xp != 3 {
+		t.Fatal("violation write was not actually blocked")
+	}
+	if err := protectedWrite(xp); err == nil {
+		t.Fatal("expected a second write to fault the same way")
+	}
+}
+
+// TestCatchViolationsUnrelatedFault tests that CatchViolations does not
+// swallow faults at addresses it didn't freeze, such as a nil pointer
+// dereference.
+func TestCatchViolationsUnrelatedFault(t *testing.T) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Fatal("expected the nil dereference to panic")
+		}
+		if _, ok := r.(*FreezeViolationError); ok {
+			t.Fatal("nil dereference was misreported as a FreezeViolationError")
+		}
+	}()
+	defer CatchViolations()()
+
+	var np *int
+	*np = 5
+}
+
+// TestUnregisterRegion tests that a region is removed from the registry once
+// its backing memory is garbage-collected and unmapped.
+func TestUnregisterRegion(t *testing.T) {
+	xp := Pointer(new(int)).(*int)
+	addr := uintptr(unsafe.Pointer(xp))
+	if !isFrozenAddr(addr) {
+		t.Fatal("freshly frozen address was not registered")
+	}
+
+	// xp is never referenced again below, so it (and the memory it points
+	// to) becomes eligible for collection here. The finalizer that
+	// unregisters addr runs asynchronously sometime after that, so poll
+	// for it rather than assuming one GC is enough.
+	for i := 0; i < 100 && isFrozenAddr(addr); i++ {
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+	if isFrozenAddr(addr) {
+		t.Fatal("region was not unregistered after its memory was freed")
+	}
+}